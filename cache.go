@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// processOCRRequest wrapped with a content-addressed cache: a hit returns
+// the stored OCR output without invoking tesseract at all. Keyed by the
+// SHA-256 of the extracted page image plus (language, output mode,
+// tesseract version, filter spec hash), so tweaking -filter, switching
+// -out, or re-running over a different -first/-last range against the
+// same pdf re-uses the same entries
+func cachedProcess(req *ocrRequest, r ocrRunner) ([]byte, error) {
+	if noCache {
+		return processAndReport(req, r)
+	}
+
+	key, err := cacheKey(req)
+	if err != nil {
+		return processAndReport(req, r) // cache is best-effort; a hashing error just means no speed-up
+	}
+
+	path := cacheEntryPath(key)
+
+	if data, ok := readCacheEntry(path); ok {
+		reportCachedThreshold(req, path)
+
+		if outputMode == outputPDF {
+			return materializePDFPage(req, data)
+		}
+
+		return data, nil
+	}
+
+	text, threshold, err := r.run(req)
+	if err != nil {
+		return nil, err
+	}
+
+	reportThreshold(req, threshold)
+
+	// in PDF mode text is the path of the per-page PDF tesseract wrote into
+	// the work dir, not the page content itself; cache the actual bytes; the
+	// path is only valid until withWorkDir's deferred RemoveAll runs
+	content := text
+
+	if outputMode == outputPDF {
+		if content, err = readAll(string(text)); err != nil {
+			return nil, err
+		}
+	}
+
+	writeCacheEntry(path, content)
+	writeCacheThreshold(path, req, threshold)
+	return text, nil
+}
+
+// runs r, skipping the cache but still honouring -report; used for
+// -no-cache and when the cache key itself can't be computed
+func processAndReport(req *ocrRequest, r ocrRunner) ([]byte, error) {
+	text, threshold, err := r.run(req)
+	if err != nil {
+		return nil, err
+	}
+
+	reportThreshold(req, threshold)
+	return text, nil
+}
+
+func reportThreshold(req *ocrRequest, threshold float64) {
+	if report && len(req.candidates) > 1 {
+		fmt.Fprintf(os.Stderr, "page %d: threshold %.1f\n", req.no+firstPage, threshold)
+	}
+}
+
+// -report's counterpart for a cache hit: process() never runs on a hit, so
+// the threshold has to be read back from the sidecar writeCacheThreshold
+// stored alongside the cached text
+func reportCachedThreshold(req *ocrRequest, path string) {
+	if !report || len(req.candidates) <= 1 {
+		return
+	}
+
+	data, err := readAll(thresholdPath(path))
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "page %d: threshold %s (cached)\n", req.no+firstPage, bytes.TrimSpace(data))
+}
+
+// writes a cached PDF page's bytes back out to a fresh file in the page's
+// work dir, since the path stashed in an older cache entry would point at a
+// work dir that withWorkDir has already removed
+func materializePDFPage(req *ocrRequest, data []byte) ([]byte, error) {
+	path := filepath.Join(filepath.Dir(req.source), fmt.Sprintf("page-%d-cached.pdf", req.no))
+
+	f, err := theFS.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return nil, err
+	}
+
+	return []byte(path), nil
+}
+
+func cacheKey(req *ocrRequest) (string, error) {
+	data, err := readAll(req.source)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(data)
+	fmt.Fprintf(h, "\x00%s\x00%s\x00%s\x00%s", language, outputMode, tesseractVersion(), filterHash())
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// radix-style layout (first two hex digits as a subdirectory) so a single
+// cache directory doesn't end up with one huge flat directory of entries
+func cacheEntryPath(key string) string {
+	dir := cacheDir
+	if dir == "" {
+		dir = defaultCacheDir()
+	}
+
+	return filepath.Join(dir, key[:2], key[2:])
+}
+
+// default cache location per the XDG base directory spec
+func defaultCacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "go-ocr")
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".cache", "go-ocr")
+}
+
+func readCacheEntry(path string) ([]byte, bool) {
+	info, err := theFS.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+
+	if cacheTTL > 0 && time.Since(info.ModTime()) > cacheTTL {
+		return nil, false
+	}
+
+	data, err := readAll(path)
+	if err != nil {
+		return nil, false
+	}
+
+	return data, true
+}
+
+func writeCacheEntry(path string, data []byte) {
+	if err := theFS.MkdirAll(filepath.Dir(path)); err != nil {
+		return
+	}
+
+	f, err := theFS.Create(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	// best-effort; a failed write just means no speed-up on the next run
+	f.Write(data)
+}
+
+// persists the threshold chosen for a page alongside its cached text, so
+// -report keeps working on a later cache hit; a no-op when there was only
+// one candidate (and so nothing was actually chosen)
+func writeCacheThreshold(path string, req *ocrRequest, threshold float64) {
+	if len(req.candidates) <= 1 {
+		return
+	}
+
+	writeCacheEntry(thresholdPath(path), []byte(fmt.Sprintf("%.1f", threshold)))
+}
+
+func thresholdPath(path string) string {
+	return path + ".threshold"
+}
+
+var (
+	tesseractVersionOnce sync.Once
+	tesseractVersionStr  string
+)
+
+// first line of 'tesseract --version', part of the cache key so upgrading
+// tesseract doesn't silently serve stale results
+func tesseractVersion() string {
+	tesseractVersionOnce.Do(func() {
+		out, _, err := runner.Run("tesseract", "--version")
+		if err != nil {
+			return
+		}
+
+		if n := bytes.IndexByte(out, '\n'); n >= 0 {
+			out = out[:n]
+		}
+
+		tesseractVersionStr = string(bytes.TrimSpace(out))
+	})
+
+	return tesseractVersionStr
+}
+
+var (
+	filterHashOnce sync.Once
+	filterHashStr  string
+)
+
+// hash over the -filter spec file names and contents, part of the cache key
+// so editing filter rules invalidates previously cached pages
+func filterHash() string {
+	filterHashOnce.Do(func() {
+		h := sha256.New()
+
+		for _, name := range filterSpecs {
+			data, err := readAll(name)
+			if err != nil {
+				continue
+			}
+
+			fmt.Fprintf(h, "%s\x00", name)
+			h.Write(data)
+		}
+
+		filterHashStr = hex.EncodeToString(h.Sum(nil))
+	})
+
+	return filterHashStr
+}
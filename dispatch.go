@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// supported '-dispatch' values
+const (
+	dispatchLocal = "local"
+	dispatchSQS   = "sqs"
+)
+
+// environment variables configuring the 'sqs' dispatcher
+const (
+	envBucket        = "OCR_SQS_BUCKET"
+	envJobQueueURL   = "OCR_SQS_JOB_QUEUE_URL"
+	envReplyQueueURL = "OCR_SQS_REPLY_QUEUE_URL"
+)
+
+// Dispatcher runs a single page's OCR job, locally or on a remote worker,
+// and returns its result
+type Dispatcher interface {
+	Dispatch(req *ocrRequest) *ocrResult
+}
+
+// the uncached OCR work behind a Dispatcher: run tesseract (or its remote
+// equivalent) over req and return the resulting text and the preprocessing
+// threshold chosen, for cachedProcess to cache and -report to print
+type ocrRunner interface {
+	run(req *ocrRequest) (text []byte, threshold float64, err error)
+}
+
+// shared by every Dispatcher implementation so caching and -report behave
+// identically regardless of -dispatch
+func dispatch(r ocrRunner, req *ocrRequest) *ocrResult {
+	res := &ocrResult{req: *req}
+	res.text, res.err = cachedProcess(req, r)
+	return res
+}
+
+// builds the Dispatcher selected by -dispatch
+func newDispatcher() (Dispatcher, error) {
+	switch dispatchMode {
+	case dispatchLocal, "":
+		return localDispatcher{}, nil
+	case dispatchSQS:
+		return newSQSDispatcher()
+	default:
+		return nil, errors.New("Unknown dispatch mode: " + dispatchMode)
+	}
+}
+
+// runs jobs in the calling goroutine via ocrRequest.process; the original,
+// and still default, behaviour
+type localDispatcher struct{}
+
+func (localDispatcher) run(req *ocrRequest) ([]byte, float64, error) {
+	return req.process()
+}
+
+func (localDispatcher) Dispatch(req *ocrRequest) *ocrResult {
+	return dispatch(localDispatcher{}, req)
+}
+
+// job message body, JSON-encoded onto the SQS job queue
+type sqsJob struct {
+	ID         string
+	No         uint
+	Bucket     string
+	Key        string
+	Language   string
+	OutputMode string
+	ReplyQueue string
+}
+
+// job result, JSON-encoded onto the SQS reply queue by the remote worker
+type sqsJobResult struct {
+	ID   string
+	Text []byte
+	Err  string
+}
+
+// dispatches page jobs to remote workers over SQS+S3, modelled on the
+// bookpipeline pipeline: the chosen page image is uploaded to an S3 bucket,
+// a job message enqueued, and the result awaited on a reply queue. Image
+// preprocessing and threshold selection (see preprocess, ocrRequest.choose)
+// still happen locally; only the tesseract invocation itself is remote.
+//
+// Every page goes through the same reply queue, so a single readLoop
+// goroutine drains it and fans results out to waiters by job ID, rather
+// than each page's goroutine polling the queue independently: ReceiveMessage
+// makes a message invisible to every poller for the queue's visibility
+// timeout, so N independent pollers would routinely steal each other's
+// replies and leave them stuck invisible until that timeout expired
+type sqsDispatcher struct {
+	sqs        *sqs.SQS
+	uploader   *s3manager.Uploader
+	bucket     string
+	jobQueue   string
+	replyQueue string
+
+	readerOnce sync.Once
+	mu         sync.Mutex
+	waiters    map[string]chan sqsJobResult
+}
+
+func newSQSDispatcher() (*sqsDispatcher, error) {
+	bucket := os.Getenv(envBucket)
+	jobQueue := os.Getenv(envJobQueueURL)
+	replyQueue := os.Getenv(envReplyQueueURL)
+
+	if bucket == "" || jobQueue == "" || replyQueue == "" {
+		return nil, fmt.Errorf("sqs dispatch requires %s, %s and %s to be set", envBucket, envJobQueueURL, envReplyQueueURL)
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqsDispatcher{
+		sqs:        sqs.New(sess),
+		uploader:   s3manager.NewUploader(sess),
+		bucket:     bucket,
+		jobQueue:   jobQueue,
+		replyQueue: replyQueue,
+		waiters:    make(map[string]chan sqsJobResult),
+	}, nil
+}
+
+func (d *sqsDispatcher) Dispatch(req *ocrRequest) *ocrResult {
+	return dispatch(d, req)
+}
+
+func (d *sqsDispatcher) run(req *ocrRequest) (text []byte, threshold float64, err error) {
+	id := fmt.Sprintf("page-%d", req.no)
+
+	// register the waiter before the job is even sent, so readLoop always
+	// has somewhere to deliver the reply no matter how fast it arrives
+	ch := make(chan sqsJobResult, 1)
+	d.addWaiter(id, ch)
+	defer d.removeWaiter(id)
+
+	d.startReader()
+
+	threshold, err = d.enqueue(req, id)
+	if err != nil {
+		return nil, threshold, err
+	}
+
+	res := <-ch
+
+	if res.Err != "" {
+		return nil, threshold, errors.New(res.Err)
+	}
+
+	return res.Text, threshold, nil
+}
+
+func (d *sqsDispatcher) enqueue(req *ocrRequest, id string) (threshold float64, err error) {
+	image, threshold, _, err := req.choose()
+	if err != nil {
+		return 0, err
+	}
+
+	key := id + filepath.Ext(image)
+
+	f, err := theFS.Open(image)
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	if _, err = d.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(key),
+		Body:   f,
+	}); err != nil {
+		return 0, err
+	}
+
+	body, err := json.Marshal(sqsJob{
+		ID:         id,
+		No:         req.no,
+		Bucket:     d.bucket,
+		Key:        key,
+		Language:   language,
+		OutputMode: outputMode,
+		ReplyQueue: d.replyQueue,
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = d.sqs.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    aws.String(d.jobQueue),
+		MessageBody: aws.String(string(body)),
+	})
+
+	return threshold, err
+}
+
+func (d *sqsDispatcher) addWaiter(id string, ch chan sqsJobResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.waiters[id] = ch
+}
+
+func (d *sqsDispatcher) removeWaiter(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.waiters, id)
+}
+
+// starts the single goroutine that drains the reply queue for this
+// dispatcher, the first time it's needed
+func (d *sqsDispatcher) startReader() {
+	d.readerOnce.Do(func() {
+		go d.readLoop()
+	})
+}
+
+// continuously drains the reply queue and hands each reply to the waiter
+// registered for its job ID. A reply is only deleted once delivered to a
+// waiter in this process; one with no registered waiter here is left on the
+// queue untouched, so that - just as in the original polling implementation -
+// the reply queue can still be shared by other processes, each with their own
+// in-flight jobs, without them stealing each other's replies off the queue
+func (d *sqsDispatcher) readLoop() {
+	for {
+		out, err := d.sqs.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(d.replyQueue),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+
+		if err != nil {
+			// transient queue error; back off briefly rather than spin
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, m := range out.Messages {
+			var res sqsJobResult
+
+			if err := json.Unmarshal([]byte(aws.StringValue(m.Body)), &res); err != nil {
+				continue
+			}
+
+			if !d.deliver(res) {
+				continue
+			}
+
+			d.sqs.DeleteMessage(&sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(d.replyQueue),
+				ReceiptHandle: m.ReceiptHandle,
+			})
+		}
+	}
+}
+
+// hands res to its waiter, if one is registered in this process, and reports
+// whether it was ours to take. A send that would block (a duplicate reply for
+// a waiter that already got its result) is dropped rather than stalling the
+// single readLoop goroutine and, with it, every other in-flight page's reply
+func (d *sqsDispatcher) deliver(res sqsJobResult) bool {
+	d.mu.Lock()
+	ch, ok := d.waiters[res.ID]
+	d.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	select {
+	case ch <- res:
+	default:
+	}
+
+	return true
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FS abstracts the filesystem operations used by the OCR pipeline, so that
+// it can run against a real directory tree or, in tests, against an
+// in-memory double without shelling out to pdfimages/tesseract
+type FS interface {
+	Open(name string) (io.ReadCloser, error)
+	Create(name string) (io.WriteCloser, error)
+	TempDir(dir, pattern string) (string, error)
+	RemoveAll(path string) error
+	Glob(pattern string) ([]string, error)
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string) error
+}
+
+// the pipeline's filesystem; overridden in tests
+var theFS FS = osFS{}
+
+// default, OS-backed FS implementation
+type osFS struct{}
+
+func (osFS) Open(name string) (io.ReadCloser, error)    { return os.Open(name) }
+func (osFS) Create(name string) (io.WriteCloser, error) { return os.Create(name) }
+func (osFS) TempDir(dir, pattern string) (string, error) {
+	return ioutil.TempDir(dir, pattern)
+}
+func (osFS) RemoveAll(path string) error           { return os.RemoveAll(path) }
+func (osFS) Glob(pattern string) ([]string, error) { return filepath.Glob(pattern) }
+func (osFS) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+func (osFS) MkdirAll(path string) error            { return os.MkdirAll(path, 0755) }
+
+// reads a whole file through the pipeline's FS
+func readAll(name string) ([]byte, error) {
+	f, err := theFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// Runner abstracts running an external command and capturing its output,
+// so that pdfimages/tesseract/convert/pdfunite invocations can be replaced
+// with a fake in tests
+type Runner interface {
+	// Run executes name with args and returns its stdout, and - on
+	// failure - its stderr for error reporting
+	Run(name string, args ...string) (stdout, stderr []byte, err error)
+}
+
+// the pipeline's command runner; overridden in tests
+var runner Runner = execRunner{}
+
+// default, os/exec-backed Runner implementation
+type execRunner struct{}
+
+func (execRunner) Run(name string, args ...string) (stdout, stderr []byte, err error) {
+	var errBuf bytes.Buffer
+
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &errBuf
+	stdout, err = cmd.Output()
+
+	return stdout, errBuf.Bytes(), err
+}
+
+// in-memory FS implementation, for tests: a flat map of path to content,
+// with enough of TempDir/Glob/RemoveAll semantics to drive the pipeline
+type memFS struct {
+	mu       sync.Mutex
+	files    map[string][]byte
+	modTimes map[string]time.Time
+	tmpSeq   int
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string][]byte), modTimes: make(map[string]time.Time)}
+}
+
+func (fs *memFS) Open(name string) (io.ReadCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	data, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (fs *memFS) Create(name string) (io.WriteCloser, error) {
+	return &memFile{fs: fs, name: name}, nil
+}
+
+func (fs *memFS) TempDir(dir, pattern string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.tmpSeq++
+	return strings.TrimSuffix(dir, "/") + fmt.Sprintf("/%smem%d", pattern, fs.tmpSeq), nil
+}
+
+func (fs *memFS) RemoveAll(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for name := range fs.files {
+		if strings.HasPrefix(name, path) {
+			delete(fs.files, name)
+			delete(fs.modTimes, name)
+		}
+	}
+
+	return nil
+}
+
+func (fs *memFS) Glob(pattern string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var matches []string
+
+	for name := range fs.files {
+		if ok, err := filepath.Match(pattern, name); err != nil {
+			return nil, err
+		} else if ok {
+			matches = append(matches, name)
+		}
+	}
+
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func (fs *memFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	data, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+
+	return memFileInfo{name: name, size: int64(len(data)), modTime: fs.modTimes[name]}, nil
+}
+
+// minimal os.FileInfo so cache.go's TTL check (theFS.Stat(path).ModTime())
+// works against memFS the same way it does against the real filesystem
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi memFileInfo) Name() string       { return filepath.Base(fi.name) }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// memFS has no real directory tree to create, so this is a no-op
+func (fs *memFS) MkdirAll(path string) error { return nil }
+
+func (fs *memFS) put(name string, data []byte) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.files[name] = data
+	fs.modTimes[name] = time.Now()
+}
+
+type memFile struct {
+	fs   *memFS
+	name string
+	buf  bytes.Buffer
+}
+
+func (f *memFile) Write(p []byte) (int, error) { return f.buf.Write(p) }
+
+func (f *memFile) Close() error {
+	f.fs.put(f.name, append([]byte(nil), f.buf.Bytes()...))
+	return nil
+}
@@ -34,16 +34,18 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 )
 
@@ -55,10 +57,39 @@ Options:
   -last  n        last page number (optional, default: last page of the document)
   -filter FILE    filter specification file name (optional, may be given multile times)
   -lang  xxx      document language (optional, default: eng)
+  -out   xxx      output mode, "txt", "hocr" or "pdf" (optional, default: txt)
+  -o     FILE     output file name (required for "-out pdf", optional otherwise;
+                  default for "-out txt"/"-out hocr" is stdout)
+  -report         print the threshold chosen for each page during preprocessing
+                  to stderr (optional)
+  -dispatch xxx   page job dispatch mode, "local" or "sqs" (optional, default: local)
+  -cache-dir DIR  page OCR cache directory (optional, default: $XDG_CACHE_HOME/go-ocr)
+  -no-cache       disable the page OCR cache (optional)
+  -cache-ttl d    cache entry lifetime, e.g. "24h" (optional, default: no expiry)
+
+-filter only applies to "-out txt"; hOCR output carries its own markup and is
+emitted unfiltered.
+
+The "sqs" dispatch mode requires OCR_SQS_BUCKET, OCR_SQS_JOB_QUEUE_URL and
+OCR_SQS_REPLY_QUEUE_URL to be set in the environment, and standard AWS
+credentials to be available.
 `
 
+// supported '-out' values
+const (
+	outputText = "txt"
+	outputHOCR = "hocr"
+	outputPDF  = "pdf"
+)
+
 var firstPage, lastPage uint
 var inputFileName, language string
+var outputMode, outputFileName string
+var report bool
+var dispatchMode string
+var cacheDir string
+var noCache bool
+var cacheTTL time.Duration
 var filterSpecs filterNames
 
 func main() {
@@ -67,6 +98,13 @@ func main() {
 	flag.UintVar(&firstPage, "first", 1, "")
 	flag.UintVar(&lastPage, "last", 0, "")
 	flag.StringVar(&language, "lang", "eng", "")
+	flag.StringVar(&outputMode, "out", outputText, "")
+	flag.StringVar(&outputFileName, "o", "", "")
+	flag.BoolVar(&report, "report", false, "")
+	flag.StringVar(&dispatchMode, "dispatch", dispatchLocal, "")
+	flag.StringVar(&cacheDir, "cache-dir", "", "")
+	flag.BoolVar(&noCache, "no-cache", false, "")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 0, "")
 	flag.Var(&filterSpecs, "filter", "")
 	flag.Parse()
 
@@ -79,6 +117,25 @@ func main() {
 		die("Too many input files")
 	}
 
+	switch outputMode {
+	case outputText:
+		runTextMode()
+	case outputHOCR:
+		runHOCRMode()
+	case outputPDF:
+		if outputFileName == "" {
+			die("-o output file is required for \"-out pdf\"")
+		}
+
+		if err := extractPDF(outputFileName); err != nil {
+			die(err.Error())
+		}
+	default:
+		die("Unknown output mode: " + outputMode)
+	}
+}
+
+func runTextMode() {
 	// read filters
 	lineFilter, textFilter, err := makeFilters()
 
@@ -93,30 +150,70 @@ func main() {
 		die(err.Error())
 	}
 
+	out, err := openOutput()
+	if err != nil {
+		die(err.Error())
+	}
+
+	defer out.Close()
+
 	// apply full-text filter
-	if _, err = os.Stdout.Write(textFilter(text.Bytes())); err != nil {
+	if _, err = out.Write(textFilter(text.Bytes())); err != nil {
 		die(err.Error())
 	}
 }
 
-func extractText(text *bytes.Buffer, filter func([]byte) []byte) (err error) {
-	// temporary directory
+func runHOCRMode() {
+	var doc bytes.Buffer
+
+	if err := extractHOCR(&doc); err != nil {
+		die(err.Error())
+	}
+
+	out, err := openOutput()
+	if err != nil {
+		die(err.Error())
+	}
+
+	defer out.Close()
+
+	if _, err = out.Write(doc.Bytes()); err != nil {
+		die(err.Error())
+	}
+}
+
+// opens the destination named by -o, or stdout if -o was not given
+func openOutput() (io.WriteCloser, error) {
+	if outputFileName == "" {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	return theFS.Create(outputFileName)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// sets up a scratch directory populated with the images extracted from the
+// input file, runs fn against it, and cleans up (including on SIGINT/SIGKILL)
+func withWorkDir(fn func(dir string) error) (err error) {
 	var dir string
 
-	dir, err = ioutil.TempDir("", "ocr-")
+	dir, err = theFS.TempDir("", "ocr-")
 	if err != nil {
 		return
 	}
 
 	dir = filepath.FromSlash(dir + "/") // make sure we have trailing slash
-	defer os.RemoveAll(dir)
+	defer theFS.RemoveAll(dir)
 
 	// signal processing
 	signals := make(chan os.Signal, 5)
 
 	go func() {
 		<-signals
-		os.RemoveAll(dir)
+		theFS.RemoveAll(dir)
 		die("Interrupted")
 	}()
 
@@ -127,8 +224,148 @@ func extractText(text *bytes.Buffer, filter func([]byte) []byte) (err error) {
 		return
 	}
 
-	// OCR
-	return ocr(dir, text, filter)
+	return fn(dir)
+}
+
+func extractText(text *bytes.Buffer, filter func([]byte) []byte) error {
+	return withWorkDir(func(dir string) error {
+		return ocr(dir, func(r *ocrResult) error {
+			reader := bytes.NewBuffer(r.text)
+
+			for s, _ := reader.ReadBytes('\n'); len(s) > 0; s, _ = reader.ReadBytes('\n') {
+				if _, err := text.Write(filter(bytes.TrimRightFunc(s, unicode.IsSpace))); err != nil {
+					return err
+				}
+
+				if err := text.WriteByte('\n'); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+}
+
+// produces a single merged hOCR document, with each page's 'ocr_page'
+// numbering rebased onto firstPage, by running tesseract's 'hocr' config
+// over each page
+func extractHOCR(doc *bytes.Buffer) error {
+	return withWorkDir(func(dir string) error {
+		doc.WriteString(hocrHeader)
+
+		err := ocr(dir, func(r *ocrResult) error {
+			page, err := hocrPageBody(r.text)
+			if err != nil {
+				return err
+			}
+
+			doc.Write(renumberHOCRPage(page, r.req.no+firstPage))
+			doc.WriteByte('\n')
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		doc.WriteString(hocrFooter)
+		return nil
+	})
+}
+
+const hocrHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+ <head>
+  <title></title>
+  <meta http-equiv="Content-Type" content="text/html;charset=utf-8"/>
+  <meta name="ocr-system" content="tesseract"/>
+  <meta name="ocr-capabilities" content="ocr_page ocr_carea ocr_par ocr_line ocrx_word"/>
+ </head>
+ <body>
+`
+
+const hocrFooter = ` </body>
+</html>
+`
+
+var hocrPageStartRe = regexp.MustCompile(`<div class='ocr_page'[^>]*>`)
+
+// pulls the 'ocr_page' div out of a single-page hOCR document produced by
+// tesseract, discarding the surrounding boilerplate that would otherwise be
+// repeated on every page of the merged document. The matching close tag is
+// found by counting nested div open/close tags rather than matching
+// "<body>...</body>" textually, since OCR'd page text ending up inside the
+// div could itself contain a literal "</body>" and throw a textual match off
+func hocrPageBody(page []byte) ([]byte, error) {
+	loc := hocrPageStartRe.FindIndex(page)
+	if loc == nil {
+		return nil, errors.New("unrecognised hOCR output from tesseract")
+	}
+
+	end, err := matchingDivEnd(page[loc[1]:])
+	if err != nil {
+		return nil, err
+	}
+
+	return page[loc[0] : loc[1]+end], nil
+}
+
+var divTagRe = regexp.MustCompile(`</?div\b[^>]*>`)
+
+// given the content following an already-consumed opening div tag, returns
+// the index one past the '>' of the div tag that closes it, accounting for
+// divs nested inside (ocr_carea, ocr_par, ocr_line, ...)
+func matchingDivEnd(body []byte) (int, error) {
+	depth := 1
+
+	for _, m := range divTagRe.FindAllIndex(body, -1) {
+		if bytes.HasPrefix(body[m[0]:], []byte("</div")) {
+			depth--
+			if depth == 0 {
+				return m[1], nil
+			}
+		} else {
+			depth++
+		}
+	}
+
+	return 0, errors.New("unrecognised hOCR output from tesseract: unterminated ocr_page div")
+}
+
+var (
+	hocrPageIDRe  = regexp.MustCompile(`id='page_\d+'`)
+	hocrPPageNoRe = regexp.MustCompile(`ppageno \d+`)
+)
+
+// rebases a page's id='page_N' and bbox title's 'ppageno N' onto the
+// document-wide page number no (derived from ocrRequest.no + firstPage),
+// since tesseract numbers every page it is given starting from 0
+func renumberHOCRPage(page []byte, no uint) []byte {
+	page = hocrPageIDRe.ReplaceAll(page, []byte(fmt.Sprintf("id='page_%d'", no)))
+	page = hocrPPageNoRe.ReplaceAll(page, []byte(fmt.Sprintf("ppageno %d", no)))
+	return page
+}
+
+// produces a searchable PDF (image + invisible text layer) at outputPath by
+// running tesseract's 'pdf' config over each page and concatenating the
+// resulting single-page PDFs in page order
+func extractPDF(outputPath string) error {
+	return withWorkDir(func(dir string) error {
+		var pages []string
+
+		err := ocr(dir, func(r *ocrResult) error {
+			pages = append(pages, string(r.text))
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return mergePDFPages(pages, outputPath)
+	})
 }
 
 // 'pdfimages' driver
@@ -141,15 +378,90 @@ func extractImages(dir string) error {
 
 	args = append(args, inputFileName, dir)
 
-	var msg bytes.Buffer
+	_, stderr, err := runner.Run("pdfimages", args...)
+
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok && len(stderr) > 0 {
+			err = errors.New(string(stderr))
+		}
+	}
+
+	return err
+}
 
-	cmd := exec.Command("pdfimages", args...)
-	cmd.Stderr = &msg
-	err := cmd.Run()
+// 'pdfunite' driver: concatenates the per-page, single-page PDFs produced by
+// tesseract's 'pdf' config into the final searchable PDF, in page order
+func mergePDFPages(pages []string, outputPath string) error {
+	args := append(append([]string{}, pages...), outputPath)
+
+	_, stderr, err := runner.Run("pdfunite", args...)
 
 	if err != nil {
-		if _, ok := err.(*exec.ExitError); ok && msg.Len() > 0 {
-			err = errors.New(msg.String())
+		if _, ok := err.(*exec.ExitError); ok && len(stderr) > 0 {
+			err = errors.New(string(stderr))
+		}
+	}
+
+	return err
+}
+
+// threshold levels (fraction of full intensity) tried when binarizing each
+// page during preprocessing
+var thresholds = []float64{0.3, 0.4, 0.5}
+
+// one page's set of binarized candidate images, aligned with thresholds
+type variantSet struct {
+	no     uint
+	source string // original extracted page image, pre-binarization
+	images []string
+}
+
+// produces, for each TIFF extracted into dir, several binarized variants at
+// the threshold levels in thresholds, so that ocr() can let tesseract pick
+// whichever reads best
+func preprocess(dir string) ([]variantSet, error) {
+	files, err := theFS.Glob(dir + "*.tif")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("No images found in file " + inputFileName)
+	}
+
+	if len(files) > 1 {
+		sort.Strings(files)
+	}
+
+	variants := make([]variantSet, len(files))
+
+	for i, file := range files {
+		vs := variantSet{no: uint(i), source: file}
+
+		for _, t := range thresholds {
+			out := fmt.Sprintf("%s-t%02d.tif", baseName(file), int(t*100))
+
+			if err := binarize(file, out, t); err != nil {
+				return nil, err
+			}
+
+			vs.images = append(vs.images, out)
+		}
+
+		variants[i] = vs
+	}
+
+	return variants, nil
+}
+
+// 'convert' driver: writes a binarized copy of src to dst at the given
+// threshold (0..1, fraction of full intensity)
+func binarize(src, dst string, threshold float64) error {
+	_, stderr, err := runner.Run("convert", src, "-threshold", fmt.Sprintf("%.0f%%", threshold*100), dst)
+
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok && len(stderr) > 0 {
+			err = errors.New(string(stderr))
 		}
 	}
 
@@ -158,30 +470,154 @@ func extractImages(dir string) error {
 
 // request/response data structures for parallel ocr
 type ocrRequest struct {
-	no    uint
-	image string
+	no         uint
+	source     string   // original extracted page image, pre-binarization; the cache key input
+	candidates []string // binarized variants of the page image, aligned with thresholds
+}
+
+// processes the request, returning the chosen preprocessing threshold
+// alongside the text so the caller can report and cache it
+func (req *ocrRequest) process() (text []byte, threshold float64, err error) {
+	image, threshold, scored, err := req.choose()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// in outputText mode the scoring run already wrote the winning
+	// candidate's text output; reuse it instead of invoking tesseract again
+	if scored != nil {
+		return scored, threshold, nil
+	}
+
+	text, err = runTesseract(image, req.no)
+	return text, threshold, err
+}
+
+// picks the candidate image with the highest mean word confidence, ties
+// broken by word count; with a single candidate it is returned unscored.
+// In outputText mode, text carries the winning candidate's text output as a
+// side effect of scoring it, so process can skip a second tesseract run; in
+// other output modes, or with a single candidate, it is nil
+func (req *ocrRequest) choose() (best string, threshold float64, text []byte, err error) {
+	if len(req.candidates) == 1 {
+		return req.candidates[0], 0, nil, nil
+	}
+
+	bestConf, bestWords := -1.0, -1
+
+	for i, image := range req.candidates {
+		conf, words, scored, err := scoreCandidate(image)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		if conf > bestConf || (conf == bestConf && words > bestWords) {
+			bestConf, bestWords, best, threshold, text = conf, words, image, thresholds[i], scored
+		}
+	}
+
+	return best, threshold, text, nil
 }
 
-func (req *ocrRequest) process() (text []byte, err error) {
-	text, err = exec.Command("tesseract", req.image, "-", "-l", language).Output()
+// runs tesseract on image, producing output in the format appropriate to
+// outputMode
+func runTesseract(image string, no uint) (text []byte, err error) {
+	var args []string
+
+	switch outputMode {
+	case outputPDF:
+		args = []string{image, baseName(image), "-l", language, "pdf"}
+	case outputHOCR:
+		args = []string{image, "-", "-l", language, "hocr"}
+	default:
+		args = []string{image, "-", "-l", language}
+	}
+
+	var stderr []byte
+	text, stderr, err = runner.Run("tesseract", args...)
 
 	if err != nil {
-		msg := fmt.Sprintf("(page %d) ", req.no+firstPage)
+		msg := fmt.Sprintf("(page %d) ", no+firstPage)
 
-		if e, ok := err.(*exec.ExitError); ok {
-			if n := bytes.IndexByte(e.Stderr, '\n'); n >= 0 { // get first line only
-				e.Stderr = e.Stderr[:n]
+		if _, ok := err.(*exec.ExitError); ok {
+			if n := bytes.IndexByte(stderr, '\n'); n >= 0 { // get first line only
+				stderr = stderr[:n]
 			}
 
-			msg += string(bytes.TrimSpace(e.Stderr))
+			msg += string(bytes.TrimSpace(stderr))
 		} else {
 			msg += err.Error()
 		}
 
-		err = errors.New(msg)
+		return nil, errors.New(msg)
 	}
 
-	return
+	if outputMode == outputPDF {
+		return []byte(baseName(image) + ".pdf"), nil
+	}
+
+	return text, nil
+}
+
+// runs tesseract's TSV output over image and returns the mean confidence of
+// its recognised words (column 11), and how many words that mean is over.
+// Since no output config file is given, tesseract also writes its default
+// plain-text output alongside the TSV; in outputText mode that is returned
+// as text, so the winning candidate doesn't need a second tesseract run
+func scoreCandidate(image string) (meanConf float64, words int, text []byte, err error) {
+	base := baseName(image)
+
+	if _, _, err = runner.Run("tesseract", image, base, "-l", language, "-c", "tessedit_create_tsv=1"); err != nil {
+		return 0, 0, nil, err
+	}
+
+	tsv, err := readAll(base + ".tsv")
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	if outputMode == outputText {
+		// best-effort: if the default text output isn't there for some
+		// reason, process falls back to a direct tesseract run
+		text, _ = readAll(base + ".txt")
+	}
+
+	meanConf, words, err = parseTSVConfidence(tsv)
+	return meanConf, words, text, err
+}
+
+func parseTSVConfidence(tsv []byte) (meanConf float64, words int, err error) {
+	var total float64
+
+	lines := bytes.Split(tsv, []byte("\n"))
+
+	for _, line := range lines[1:] { // skip header row
+		cols := bytes.Split(line, []byte("\t"))
+		if len(cols) < 12 {
+			continue
+		}
+
+		conf, err := strconv.ParseFloat(string(cols[10]), 64)
+		if err != nil || conf <= 0 {
+			continue
+		}
+
+		total += conf
+		words++
+	}
+
+	if words == 0 {
+		return 0, 0, nil
+	}
+
+	return total / float64(words), words, nil
+}
+
+// base name tesseract writes its file outputs under, i.e. image path
+// without its extension; tesseract itself appends the relevant suffix
+// (".pdf", ".tsv", ...)
+func baseName(image string) string {
+	return strings.TrimSuffix(image, filepath.Ext(image))
 }
 
 type ocrResult struct {
@@ -190,12 +626,6 @@ type ocrResult struct {
 	text []byte
 }
 
-func processOCRRequest(req *ocrRequest) (r *ocrResult) {
-	r = &ocrResult{req: *req}
-	r.text, r.err = req.process()
-	return
-}
-
 // heap of ocrResult structures for restoring the original page order
 type resultHeap []*ocrResult
 
@@ -212,26 +642,23 @@ func (h *resultHeap) Pop() interface{} {
 	return val
 }
 
-// OCR driver
-func ocr(dir string, text *bytes.Buffer, filter func([]byte) []byte) error {
-	// list all image files
-	files, err := filepath.Glob(dir + "*.tif")
+// OCR driver: preprocesses and runs tesseract over all images in dir in
+// parallel, then delivers each result to onResult in page order
+func ocr(dir string, onResult func(*ocrResult) error) error {
+	variants, err := preprocess(dir)
 	if err != nil {
 		return err
 	}
 
-	if len(files) == 0 {
-		return errors.New("No images found in file " + inputFileName)
-	}
-
-	if len(files) > 1 {
-		sort.Strings(files)
+	dispatcher, err := newDispatcher()
+	if err != nil {
+		return err
 	}
 
 	// channels
 	n := runtime.NumCPU()
 	results := make(chan *ocrResult, n)
-	requests := make(chan *ocrRequest, len(files))
+	requests := make(chan *ocrRequest, len(variants))
 	var wg sync.WaitGroup
 
 	// workers
@@ -242,7 +669,7 @@ func ocr(dir string, text *bytes.Buffer, filter func([]byte) []byte) error {
 			defer wg.Done()
 
 			for req := range requests {
-				results <- processOCRRequest(req)
+				results <- dispatcher.Dispatch(req)
 			}
 		}()
 	}
@@ -253,8 +680,8 @@ func ocr(dir string, text *bytes.Buffer, filter func([]byte) []byte) error {
 	}()
 
 	// fill in request channel
-	for i, file := range files {
-		requests <- &ocrRequest{uint(i), file}
+	for _, vs := range variants {
+		requests <- &ocrRequest{vs.no, vs.source, vs.images}
 	}
 
 	close(requests)
@@ -275,17 +702,8 @@ func ocr(dir string, text *bytes.Buffer, filter func([]byte) []byte) error {
 				return r.err
 			}
 
-			// process the result
-			reader := bytes.NewBuffer(r.text)
-
-			for s, _ := reader.ReadBytes('\n'); len(s) > 0; s, _ = reader.ReadBytes('\n') {
-				if _, err := text.Write(filter(bytes.TrimRightFunc(s, unicode.IsSpace))); err != nil {
-					return err
-				}
-
-				if err := text.WriteByte('\n'); err != nil {
-					return err
-				}
+			if err := onResult(r); err != nil {
+				return err
 			}
 		}
 	}
@@ -312,9 +730,9 @@ func makeFilters() (lineFilter, textFilter func([]byte) []byte, err error) {
 	rules := new(ruleList)
 
 	for _, name := range filterSpecs {
-		var file *os.File
+		var file io.ReadCloser
 
-		if file, err = os.Open(name); err != nil {
+		if file, err = theFS.Open(name); err != nil {
 			return
 		}
 
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRunner simulates pdfimages/convert/tesseract/pdfunite against a
+// memFS, so the OCR driver can be exercised without shelling out or
+// touching disk. ocr() dispatches to it from multiple worker goroutines,
+// so calls is guarded by mu
+type fakeRunner struct {
+	fs *memFS
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func newFakeRunner(fs *memFS) *fakeRunner {
+	return &fakeRunner{fs: fs, calls: make(map[string]int)}
+}
+
+func (r *fakeRunner) Run(name string, args ...string) (stdout, stderr []byte, err error) {
+	r.mu.Lock()
+	r.calls[name]++
+	r.mu.Unlock()
+
+	switch name {
+	case "pdfimages":
+		dir := args[len(args)-1]
+		r.fs.put(dir+"page-000.tif", []byte("page0"))
+		r.fs.put(dir+"page-001.tif", []byte("page1"))
+		return nil, nil, nil
+	case "convert":
+		return r.convert(args[0], args[len(args)-1])
+	case "tesseract":
+		return r.tesseract(args)
+	case "pdfunite":
+		return r.pdfunite(args)
+	default:
+		return nil, nil, nil
+	}
+}
+
+func (r *fakeRunner) convert(src, dst string) (stdout, stderr []byte, err error) {
+	data, err := readAll(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.fs.put(dst, data)
+	return nil, nil, nil
+}
+
+// the t40 variant always scores highest, so tests can assert the preprocess
+// stage picked it
+func (r *fakeRunner) tesseract(args []string) (stdout, stderr []byte, err error) {
+	image := args[0]
+	last := args[len(args)-1]
+
+	switch last {
+	case "hocr":
+		return r.tesseractHOCR(image)
+	case "pdf":
+		return r.tesseractPDF(image, args[1])
+	}
+
+	for _, a := range args {
+		if a != "tessedit_create_tsv=1" {
+			continue
+		}
+
+		conf := "50"
+		if strings.Contains(image, "-t40.tif") {
+			conf = "95"
+		}
+
+		tsv := "level\tpage_num\tblock_num\tpar_num\tline_num\tword_num\tleft\ttop\twidth\theight\tconf\ttext\n" +
+			"5\t1\t1\t1\t1\t1\t0\t0\t1\t1\t" + conf + "\tword\n"
+
+		r.fs.put(args[1]+".tsv", []byte(tsv))
+
+		// mimics tesseract writing its default plain-text output alongside
+		// the requested tsv, which scoreCandidate reuses for the winner
+		data, err := readAll(image)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		r.fs.put(args[1]+".txt", data)
+		return nil, nil, nil
+	}
+
+	data, err := readAll(image)
+	return data, nil, err
+}
+
+// tesseract always numbers a single-page hOCR document's own page as 0;
+// renumberHOCRPage is what rebases it onto the document-wide page number
+func (r *fakeRunner) tesseractHOCR(image string) (stdout, stderr []byte, err error) {
+	data, err := readAll(image)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	doc := fmt.Sprintf(
+		"<html>\n <body>\n  <div class='ocr_page' id='page_0' title=\"image %q; bbox 0 0 1 1; ppageno 0\">%s</div>\n </body>\n</html>\n",
+		image, data)
+
+	return []byte(doc), nil, nil
+}
+
+func (r *fakeRunner) tesseractPDF(image, base string) (stdout, stderr []byte, err error) {
+	data, err := readAll(image)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.fs.put(base+".pdf", data)
+	return nil, nil, nil
+}
+
+// concatenates its input files' contents into the output path, standing in
+// for the real pdfunite binary
+func (r *fakeRunner) pdfunite(args []string) (stdout, stderr []byte, err error) {
+	out := args[len(args)-1]
+
+	var buf bytes.Buffer
+
+	for _, page := range args[:len(args)-1] {
+		data, err := readAll(page)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		buf.Write(data)
+	}
+
+	r.fs.put(out, buf.Bytes())
+	return nil, nil, nil
+}
+
+func (r *fakeRunner) callCount(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.calls[name]
+}
+
+func withFakePipeline(t *testing.T, fn func(fs *memFS, r *fakeRunner)) {
+	t.Helper()
+
+	fs := newMemFS()
+	fr := newFakeRunner(fs)
+	prevFS, prevRunner := theFS, runner
+	theFS, runner = fs, fr
+
+	t.Cleanup(func() {
+		theFS, runner = prevFS, prevRunner
+	})
+
+	fn(fs, fr)
+}
+
+func TestExtractTextPreservesPageOrder(t *testing.T) {
+	withFakePipeline(t, func(fs *memFS, r *fakeRunner) {
+		outputMode = outputText
+		language = "eng"
+		dispatchMode = dispatchLocal
+		noCache = true
+
+		var text bytes.Buffer
+
+		if err := extractText(&text, func(s []byte) []byte { return s }); err != nil {
+			t.Fatalf("extractText: %v", err)
+		}
+
+		if got, want := text.String(), "page0\npage1\n"; got != want {
+			t.Errorf("extractText() = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestChooseBestThreshold(t *testing.T) {
+	withFakePipeline(t, func(fs *memFS, r *fakeRunner) {
+		outputMode = outputText
+		language = "eng"
+
+		dir := "/doc1/"
+		fs.put(dir+"page-000.tif", []byte("page0"))
+
+		variants, err := preprocess(dir)
+		if err != nil {
+			t.Fatalf("preprocess: %v", err)
+		}
+
+		if len(variants) != 1 {
+			t.Fatalf("got %d variants, want 1", len(variants))
+		}
+
+		req := &ocrRequest{variants[0].no, variants[0].source, variants[0].images}
+
+		image, threshold, _, err := req.choose()
+		if err != nil {
+			t.Fatalf("choose: %v", err)
+		}
+
+		if threshold != 0.4 {
+			t.Errorf("chose threshold %.1f, want 0.4", threshold)
+		}
+
+		if !strings.Contains(image, "-t40.tif") {
+			t.Errorf("chose image %q, want the t40 variant", image)
+		}
+	})
+}
+
+func TestProcessReusesScoringTextOutput(t *testing.T) {
+	withFakePipeline(t, func(fs *memFS, r *fakeRunner) {
+		outputMode = outputText
+		language = "eng"
+
+		dir := "/doc3/"
+		fs.put(dir+"page-000.tif", []byte("page0"))
+
+		variants, err := preprocess(dir)
+		if err != nil {
+			t.Fatalf("preprocess: %v", err)
+		}
+
+		req := &ocrRequest{variants[0].no, variants[0].source, variants[0].images}
+
+		text, _, err := req.process()
+		if err != nil {
+			t.Fatalf("process: %v", err)
+		}
+
+		if got, want := string(text), "page0"; got != want {
+			t.Errorf("process() text = %q, want %q", got, want)
+		}
+
+		// one scoring run per candidate (len(thresholds)), and none beyond
+		// that to re-run tesseract on the winner
+		if got, want := r.callCount("tesseract"), len(thresholds); got != want {
+			t.Errorf("tesseract invoked %d times, want %d (no re-run on the winner)", got, want)
+		}
+	})
+}
+
+func TestExtractHOCRRenumbersPages(t *testing.T) {
+	withFakePipeline(t, func(fs *memFS, r *fakeRunner) {
+		outputMode = outputHOCR
+		language = "eng"
+		dispatchMode = dispatchLocal
+		noCache = true
+		firstPage = 1
+
+		var doc bytes.Buffer
+
+		if err := extractHOCR(&doc); err != nil {
+			t.Fatalf("extractHOCR: %v", err)
+		}
+
+		got := doc.String()
+
+		if i0, i1 := strings.Index(got, "page0"), strings.Index(got, "page1"); i0 < 0 || i1 < 0 || i0 > i1 {
+			t.Fatalf("pages out of order or missing: %q", got)
+		}
+
+		if !strings.Contains(got, "id='page_1'") || !strings.Contains(got, "id='page_2'") {
+			t.Errorf("expected pages renumbered onto firstPage, got %q", got)
+		}
+	})
+}
+
+func TestExtractPDFConcatenatesInPageOrder(t *testing.T) {
+	withFakePipeline(t, func(fs *memFS, r *fakeRunner) {
+		outputMode = outputPDF
+		language = "eng"
+		dispatchMode = dispatchLocal
+		noCache = true
+
+		if err := extractPDF("/out.pdf"); err != nil {
+			t.Fatalf("extractPDF: %v", err)
+		}
+
+		data, err := readAll("/out.pdf")
+		if err != nil {
+			t.Fatalf("reading merged pdf: %v", err)
+		}
+
+		if got, want := string(data), "page0page1"; got != want {
+			t.Errorf("merged pdf = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestHOCRPageBodySurvivesEmbeddedBodyTag(t *testing.T) {
+	page := []byte("<html>\n <body>\n  <div class='ocr_page' id='page_0' title=\"bbox 0 0 1 1; ppageno 0\">" +
+		"<div class='ocr_carea'><span class='ocrx_word'>literally &lt;/body&gt; in the scan</span></div>" +
+		"</div>\n </body>\n</html>\n")
+
+	got, err := hocrPageBody(page)
+	if err != nil {
+		t.Fatalf("hocrPageBody: %v", err)
+	}
+
+	want := "<div class='ocr_page' id='page_0' title=\"bbox 0 0 1 1; ppageno 0\">" +
+		"<div class='ocr_carea'><span class='ocrx_word'>literally &lt;/body&gt; in the scan</span></div>" +
+		"</div>"
+
+	if string(got) != want {
+		t.Errorf("hocrPageBody() = %q, want %q", got, want)
+	}
+}
+
+func TestCachedProcessSkipsTesseractOnHit(t *testing.T) {
+	withFakePipeline(t, func(fs *memFS, r *fakeRunner) {
+		outputMode = outputText
+		language = "eng"
+		noCache = false
+		cacheDir = "/cache1/"
+		defer func() { cacheDir = "" }()
+
+		dir := "/doc2/"
+		fs.put(dir+"page-000.tif", []byte("page0"))
+
+		req := &ocrRequest{0, dir + "page-000.tif", []string{dir + "page-000.tif"}}
+
+		text, err := cachedProcess(req, localDispatcher{})
+		if err != nil {
+			t.Fatalf("cachedProcess (miss): %v", err)
+		}
+
+		if got, want := string(text), "page0"; got != want {
+			t.Fatalf("cachedProcess (miss) = %q, want %q", got, want)
+		}
+
+		callsAfterMiss := r.callCount("tesseract")
+		if callsAfterMiss == 0 {
+			t.Fatalf("expected a cache miss to invoke tesseract")
+		}
+
+		text, err = cachedProcess(req, localDispatcher{})
+		if err != nil {
+			t.Fatalf("cachedProcess (hit): %v", err)
+		}
+
+		if got, want := string(text), "page0"; got != want {
+			t.Errorf("cachedProcess (hit) = %q, want %q", got, want)
+		}
+
+		if got := r.callCount("tesseract"); got != callsAfterMiss {
+			t.Errorf("tesseract invoked again on a cache hit: %d calls before, %d after", callsAfterMiss, got)
+		}
+	})
+}